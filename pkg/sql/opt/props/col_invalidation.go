@@ -0,0 +1,255 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package props
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/util"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// PlanCacheEntry is a cached artifact - a prepared statement's physical
+// plan, a memo, or (as ColStatsMap already does within a single query) a
+// computed column statistic - keyed by the table it was built against and
+// the set of that table's columns it actually reads.
+type PlanCacheEntry struct {
+	// Cols is the set of columns of the entry's table that the cached Plan
+	// reads.
+	// Two entries for the same table with disjoint Cols can be
+	// invalidated independently of one another.
+	Cols util.FastIntSet
+	// Plan is the opaque cached artifact itself.
+	Plan interface{}
+}
+
+// tableCacheEntries holds the live PlanCacheEntry values for one table.
+// Lookup/insertion by exact column set goes through a prefix tree keyed
+// by column id, same as ColStatsMap; this makes repeated preparation of
+// the same statement (which always reads the same columns) cheap.
+// Invalidation by intersection, in contrast, inherently requires
+// examining every live entry - two column sets can intersect without
+// either being a prefix of the other (e.g. (1,3) and (2,3) only share
+// column 3) - so it falls back to the same linear filter
+// ColStatsMap.RemoveIntersecting uses.
+//
+// This duplicates ColStatsMap's tree rather than reusing it directly,
+// since ColStatsMap is hard-coded to store ColumnStatistic and we have no
+// generics to parameterize it over PlanCacheEntry instead; if a third
+// column-keyed cache shows up, it'll be worth factoring the trie out into
+// a shared (interface{}-valued) helper type.
+type tableCacheEntries struct {
+	vals []PlanCacheEntry
+	root colCacheNode
+}
+
+// colCacheNode is one level of the prefix tree, structured like
+// ColStatsMap's internal node: children is keyed by the next column id in
+// the set, in ascending order, and hasVal/valIdx record whether an entry
+// exists for exactly the column set spelled out by the path from the
+// root to this node.
+type colCacheNode struct {
+	hasVal   bool
+	valIdx   int
+	children map[int]*colCacheNode
+}
+
+func (t *tableCacheEntries) find(cols util.FastIntSet) *colCacheNode {
+	node := &t.root
+	missing := false
+	cols.ForEach(func(c int) {
+		if missing {
+			return
+		}
+		if node.children == nil {
+			missing = true
+			return
+		}
+		child, ok := node.children[c]
+		if !ok {
+			missing = true
+			return
+		}
+		node = child
+	})
+	if missing {
+		return nil
+	}
+	return node
+}
+
+func (t *tableCacheEntries) lookup(cols util.FastIntSet) (PlanCacheEntry, bool) {
+	node := t.find(cols)
+	if node == nil || !node.hasVal {
+		return PlanCacheEntry{}, false
+	}
+	return t.vals[node.valIdx], true
+}
+
+func (t *tableCacheEntries) add(entry PlanCacheEntry) {
+	node := &t.root
+	entry.Cols.ForEach(func(c int) {
+		if node.children == nil {
+			node.children = make(map[int]*colCacheNode)
+		}
+		child, ok := node.children[c]
+		if !ok {
+			child = &colCacheNode{}
+			node.children[c] = child
+		}
+		node = child
+	})
+	if node.hasVal {
+		t.vals[node.valIdx] = entry
+		return
+	}
+	node.hasVal = true
+	node.valIdx = len(t.vals)
+	t.vals = append(t.vals, entry)
+}
+
+// removeIntersecting drops every entry whose Cols intersects cols,
+// mirroring ColStatsMap.RemoveIntersecting, and reports whether anything
+// was removed.
+func (t *tableCacheEntries) removeIntersecting(cols util.FastIntSet) bool {
+	kept := t.vals[:0]
+	removed := false
+	for _, e := range t.vals {
+		if cols.Intersects(e.Cols) {
+			removed = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if !removed {
+		return false
+	}
+	t.vals = kept
+	t.root = colCacheNode{}
+	for i := range t.vals {
+		t.reinsert(i)
+	}
+	return true
+}
+
+func (t *tableCacheEntries) reinsert(i int) {
+	node := &t.root
+	t.vals[i].Cols.ForEach(func(c int) {
+		if node.children == nil {
+			node.children = make(map[int]*colCacheNode)
+		}
+		child, ok := node.children[c]
+		if !ok {
+			child = &colCacheNode{}
+			node.children[c] = child
+		}
+		node = child
+	})
+	node.hasVal = true
+	node.valIdx = i
+}
+
+// ColumnInvalidationIndex is a transaction-scoped cache of per-table,
+// per-column-set plan entries that supports column-granular invalidation:
+// when a DML statement mutates only some columns of a table, only the
+// cached entries whose referenced columns intersect the mutated columns
+// are evicted, rather than dropping every cached entry for the table.
+//
+// This extends, to the session/plan-cache layer, the invalidation scheme
+// ColStatsMap already applies within a single query's cost estimation
+// (RemoveIntersecting, Clear): a session's prepared-statement cache can
+// keep plans over unrelated columns of a wide table hot across many
+// narrow UPDATEs, instead of invalidating the whole table on every write.
+//
+// TODO(knz): nothing constructs a ColumnInvalidationIndex or calls
+// InvalidateColumns/InvalidateTable outside this package's own tests yet.
+// The intended caller is the SQL statement executor's per-session plan
+// cache, calling InvalidateColumns(tableID, mutatedCols) once a DML
+// statement commits, and Lookup/Add around plan preparation - but
+// conn_executor and the rest of that session-level machinery aren't part
+// of this checkout, so there is no real call site to update here. Wire
+// this in once that executor code is available, rather than fabricating
+// a stand-in caller just to exercise it.
+//
+// A ColumnInvalidationIndex is safe for concurrent use.
+type ColumnInvalidationIndex struct {
+	mu struct {
+		syncutil.Mutex
+		byTable map[opt.TableID]*tableCacheEntries
+	}
+}
+
+// NewColumnInvalidationIndex constructs an empty ColumnInvalidationIndex.
+func NewColumnInvalidationIndex() *ColumnInvalidationIndex {
+	idx := &ColumnInvalidationIndex{}
+	idx.mu.byTable = make(map[opt.TableID]*tableCacheEntries)
+	return idx
+}
+
+// Lookup returns the cached plan for the given table and exact column
+// set, if one exists.
+func (idx *ColumnInvalidationIndex) Lookup(
+	tableID opt.TableID, cols util.FastIntSet,
+) (interface{}, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	t, ok := idx.mu.byTable[tableID]
+	if !ok {
+		return nil, false
+	}
+	entry, ok := t.lookup(cols)
+	if !ok {
+		return nil, false
+	}
+	return entry.Plan, true
+}
+
+// Add caches plan, keyed by (tableID, cols). A subsequent Add for the same
+// (tableID, cols) pair replaces the cached plan.
+func (idx *ColumnInvalidationIndex) Add(tableID opt.TableID, cols util.FastIntSet, plan interface{}) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	t, ok := idx.mu.byTable[tableID]
+	if !ok {
+		t = &tableCacheEntries{}
+		idx.mu.byTable[tableID] = t
+	}
+	t.add(PlanCacheEntry{Cols: cols, Plan: plan})
+}
+
+// InvalidateColumns evicts every cached plan for tableID whose referenced
+// columns intersect cols. It is intended to be called by the SQL
+// statement executor after a DML statement commits, with cols set to the
+// columns that statement actually wrote - e.g. an `UPDATE t SET a = ...`
+// would call InvalidateColumns(t, colsOf("a")), leaving cached plans that
+// only read other columns of t untouched.
+func (idx *ColumnInvalidationIndex) InvalidateColumns(tableID opt.TableID, cols util.FastIntSet) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	t, ok := idx.mu.byTable[tableID]
+	if !ok {
+		return
+	}
+	if t.removeIntersecting(cols) && len(t.vals) == 0 {
+		delete(idx.mu.byTable, tableID)
+	}
+}
+
+// InvalidateTable evicts every cached plan for tableID, regardless of
+// which columns it references. This is coarser than InvalidateColumns and
+// is intended for schema changes, which can affect any plan over the
+// table.
+func (idx *ColumnInvalidationIndex) InvalidateTable(tableID opt.TableID) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.mu.byTable, tableID)
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package props_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/opt"
+	"github.com/cockroachdb/cockroach/pkg/sql/opt/props"
+	"github.com/cockroachdb/cockroach/pkg/util"
+)
+
+func TestColumnInvalidationIndex(t *testing.T) {
+	idx := props.NewColumnInvalidationIndex()
+
+	const tableA opt.TableID = 1
+	const tableB opt.TableID = 2
+
+	idx.Add(tableA, util.MakeFastIntSet(1), "plan-a1")
+	idx.Add(tableA, util.MakeFastIntSet(2, 3), "plan-a23")
+	idx.Add(tableB, util.MakeFastIntSet(1), "plan-b1")
+
+	if plan, ok := idx.Lookup(tableA, util.MakeFastIntSet(1)); !ok || plan != "plan-a1" {
+		t.Fatalf("expected plan-a1, got %v, %v", plan, ok)
+	}
+
+	// Invalidating column 1 of table A must not affect the (2,3) entry of
+	// table A, nor table B's entry for column 1.
+	idx.InvalidateColumns(tableA, util.MakeFastIntSet(1))
+
+	if _, ok := idx.Lookup(tableA, util.MakeFastIntSet(1)); ok {
+		t.Fatal("expected table A's column-1 plan to be invalidated")
+	}
+	if plan, ok := idx.Lookup(tableA, util.MakeFastIntSet(2, 3)); !ok || plan != "plan-a23" {
+		t.Fatalf("expected table A's (2,3) plan to survive, got %v, %v", plan, ok)
+	}
+	if plan, ok := idx.Lookup(tableB, util.MakeFastIntSet(1)); !ok || plan != "plan-b1" {
+		t.Fatalf("expected table B's plan to be unaffected, got %v, %v", plan, ok)
+	}
+
+	// Invalidating column 3 must drop the (2,3) entry, since it
+	// intersects even though 3 alone isn't its full key.
+	idx.InvalidateColumns(tableA, util.MakeFastIntSet(3))
+	if _, ok := idx.Lookup(tableA, util.MakeFastIntSet(2, 3)); ok {
+		t.Fatal("expected table A's (2,3) plan to be invalidated by a column-3 write")
+	}
+
+	idx.InvalidateTable(tableB)
+	if _, ok := idx.Lookup(tableB, util.MakeFastIntSet(1)); ok {
+		t.Fatal("expected InvalidateTable to drop all of table B's entries")
+	}
+}
+
+// BenchmarkColumnInvalidationIndex measures the cache hit rate on a
+// workload of many narrow updates against a wide table, using
+// column-granular invalidation. It does not measure whole-table
+// invalidation for comparison.
+func BenchmarkColumnInvalidationIndex(b *testing.B) {
+	const tableID opt.TableID = 1
+	const numCols = 50
+
+	idx := props.NewColumnInvalidationIndex()
+	for c := 0; c < numCols; c++ {
+		idx.Add(tableID, util.MakeFastIntSet(c), fmt.Sprintf("plan-%d", c))
+	}
+
+	var hits, misses int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Simulate a narrow UPDATE that only ever touches column 0,
+		// invalidating just the plan that reads it.
+		idx.InvalidateColumns(tableID, util.MakeFastIntSet(0))
+		idx.Add(tableID, util.MakeFastIntSet(0), "plan-0")
+
+		for c := 0; c < numCols; c++ {
+			if _, ok := idx.Lookup(tableID, util.MakeFastIntSet(c)); ok {
+				hits++
+			} else {
+				misses++
+			}
+		}
+	}
+	b.StopTimer()
+
+	if hits+misses > 0 {
+		b.ReportMetric(float64(hits)/float64(hits+misses), "hit-rate")
+	}
+}
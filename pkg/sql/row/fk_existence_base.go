@@ -13,12 +13,15 @@
 package row
 
 import (
+	"context"
 	"errors"
 	"sort"
 
 	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 )
 
 // fkExistenceCheckBaseHelper is an auxiliary struct that facilitates FK existence
@@ -80,6 +83,15 @@ type fkExistenceCheckBaseHelper struct {
 	// mutatedIdx is the descriptor for the target index being mutated.
 	// Stored only for error messages.
 	mutatedIdx *sqlbase.IndexDescriptor
+
+	// cache memoizes existence check results keyed by the searched
+	// index's KV key bytes, so that repeated checks against the same
+	// referenced value (e.g. a batch of child rows pointing at the same
+	// parent) don't each cost a KV round-trip. See fkExistenceCache.
+	cache *fkExistenceCache
+	// tableIndex identifies searchTable/searchIdx for the purposes of
+	// cache lookups and invalidation.
+	tableIndex fkExistenceCacheTableIndex
 }
 
 // makeFkExistenceCheckBaseHelper instantiates a FK helper.
@@ -109,6 +121,16 @@ type fkExistenceCheckBaseHelper struct {
 // - otherTables is an object that provides schema extraction services.
 //   TODO(knz): this should become homogeneous across the 3 packages
 //   sql, sqlbase, row. The proliferation is annoying.
+//
+// The returned helper starts out with its own private existence check
+// cache, sized from the compiled-in default for
+// sql.fk_existence_check_cache.size. Callers that build more than one
+// helper for the same mutation (one per FK constraint is typical) or
+// that want the cache to survive beyond a single statement should call
+// UseSharedCache with a *fkExistenceCache constructed once per
+// transaction and shared across every helper built against that
+// transaction; calling SetClusterSettings on that cache makes it track
+// the live cluster setting.
 func makeFkExistenceCheckBaseHelper(
 	txn *client.Txn,
 	otherTables FkTableMetadata,
@@ -158,6 +180,8 @@ func makeFkExistenceCheckBaseHelper(
 		return ret, err
 	}
 
+	tableIndex := fkExistenceCacheTableIndex{tableID: searchTable.GetID(), indexID: searchIdx.ID}
+
 	return fkExistenceCheckBaseHelper{
 		txn:          txn,
 		dir:          dir,
@@ -169,9 +193,158 @@ func makeFkExistenceCheckBaseHelper(
 		prefixLen:    prefixLen,
 		searchPrefix: searchPrefix,
 		mutatedIdx:   mutatedIdx,
+		cache:        newFkExistenceCache(),
+		tableIndex:   tableIndex,
 	}, nil
 }
 
+// UseSharedCache replaces this helper's existence check cache with one
+// shared across every fkExistenceCheckBaseHelper built for the same
+// mutation (and, if the caller retains it across statements, the same
+// transaction). A cache entry populated while checking one row -
+// including entries for other FK constraints that happen to search the
+// same table/index - is then available when checking the next, which is
+// what makes the per-transaction memoization described in
+// sql.fk_existence_check_cache.size actually pay off: a cache created
+// fresh for every helper (the default if this is never called) only ever
+// sees the rows of the single call site that built it.
+//
+// Callers that build multiple helpers for one mutation (one per FK
+// constraint, the common case) should construct a single
+// *fkExistenceCache up front, via newFkExistenceCache, and pass it to
+// UseSharedCache on each helper before processing any rows.
+func (h *fkExistenceCheckBaseHelper) UseSharedCache(cache *fkExistenceCache) {
+	h.cache = cache
+}
+
+// invalidateCache drops any existence check results cached for this
+// helper's searched table/index. It must be called - on every helper
+// sharing the cache via UseSharedCache - after this transaction issues a
+// DML statement against that table/index, since such a statement may
+// have added or removed rows that earlier lookups did not observe.
+func (h *fkExistenceCheckBaseHelper) invalidateCache() {
+	h.cache.invalidate(h.tableIndex)
+}
+
+// CacheStats reports the hit/miss counters for this helper's existence
+// check cache, for use by EXPLAIN ANALYZE and crdb_internal introspection.
+func (h *fkExistenceCheckBaseHelper) CacheStats() (hits, misses int64) {
+	return h.cache.stats.Hits(), h.cache.stats.Misses()
+}
+
+// buildLookupKey encodes the KV key used to look up one row in the
+// searched table/index: searchPrefix followed by the ascending-encoded
+// values, in searchIdx column order.
+func (h *fkExistenceCheckBaseHelper) buildLookupKey(values tree.Datums) ([]byte, error) {
+	key := append([]byte(nil), h.searchPrefix...)
+	for _, v := range values {
+		var err error
+		key, err = sqlbase.EncodeTableKey(key, v, encoding.Ascending)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// partialMatchLookupValues applies the MATCH PARTIAL per-row decision
+// (see fkMatchPartialLookupPrefix) to values, returning the values to
+// actually use for the KV lookup key. skip reports that values is an
+// all-NULL row that needs no check at all, same as MATCH SIMPLE. For
+// MATCH styles other than PARTIAL, values is returned unchanged.
+func (h *fkExistenceCheckBaseHelper) partialMatchLookupValues(
+	values tree.Datums,
+) (lookupValues tree.Datums, skip bool, err error) {
+	if h.ref.Match != sqlbase.ForeignKeyReference_PARTIAL {
+		return values, false, nil
+	}
+	skip, prefixLen, hasNonNullAfterPrefix := fkMatchPartialLookupPrefix(values)
+	if skip {
+		return nil, true, nil
+	}
+	if hasNonNullAfterPrefix {
+		// A non-contiguous run of non-NULL values (e.g. (1, NULL, 3))
+		// can't be expressed as a single KV key prefix: doing so exactly
+		// requires fetching every row matching prefixLen and filtering
+		// it against the remaining non-NULL positions, which needs a
+		// real row fetch (via h.rf) rather than the boolean existsBatch
+		// this helper has today. Checking only the leading prefix until
+		// that fetch-and-filter path exists would silently accept rows
+		// that don't actually match in the trailing columns - a
+		// correctness regression from the previous blanket
+		// UnimplementedWithIssue for all of MATCH PARTIAL - so report it
+		// loudly instead.
+		//
+		// TODO(knz): implement the fetch-and-filter path and drop this
+		// case.
+		return nil, false, pgerror.UnimplementedWithIssue(20305,
+			"MATCH PARTIAL with non-contiguous NULLs not supported")
+	}
+	return values[:prefixLen], false, nil
+}
+
+// checkRow is the per-row FK existence check entry point: given the
+// values of the searched-index columns for one mutated row (in searchIdx
+// order), it consults (and populates) h.cache and reports a foreign key
+// violation if no matching row exists in the searched table/index.
+//
+// checkRow issues its own KV round-trip per call. Table writers that
+// process more than one mutated row against the same FK constraint at a
+// time (e.g. a multi-row INSERT) should call checkRows instead, which
+// coalesces every row's lookup into a single KV Batch.
+func (h *fkExistenceCheckBaseHelper) checkRow(ctx context.Context, values tree.Datums) error {
+	return h.checkRows(ctx, []tree.Datums{values})
+}
+
+// checkRows is the batch form of checkRow: given the searched-index
+// values for several mutated rows checked against the same FK
+// constraint, it coalesces all of their existence checks into a single
+// call to existsBatch - and therefore a single KV Batch - rather than
+// issuing one round-trip per row the way calling checkRow once per row
+// would.
+func (h *fkExistenceCheckBaseHelper) checkRows(ctx context.Context, rows []tree.Datums) error {
+	keys := make([][]byte, 0, len(rows))
+	rowForKey := make(map[string]tree.Datums, len(rows))
+	for _, values := range rows {
+		lookupValues, skip, err := h.partialMatchLookupValues(values)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		key, err := h.buildLookupKey(lookupValues)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		rowForKey[string(key)] = values
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	results, err := h.existsBatch(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !results[string(key)] {
+			return h.violationError(rowForKey[string(key)])
+		}
+	}
+	return nil
+}
+
+// violationError builds the error reported when checkRow (or a caller of
+// existsBatch) finds no matching row for values in the searched
+// table/index.
+func (h *fkExistenceCheckBaseHelper) violationError(values tree.Datums) error {
+	return pgerror.Newf(pgerror.CodeForeignKeyViolationError,
+		"foreign key violation: value %s not found in %s@%s",
+		values, h.searchTable.Name, h.searchIdx.Name)
+}
+
 // computeFkCheckColumnIDs determines the set of column IDs to use for
 // the existence check, depending on the MATCH style.
 //
@@ -227,11 +400,78 @@ func computeFkCheckColumnIDs(
 		}
 
 	case sqlbase.ForeignKeyReference_PARTIAL:
-		return nil, pgerror.UnimplementedWithIssue(20305, "MATCH PARTIAL not supported")
+		// Unlike SIMPLE and FULL, MATCH PARTIAL cannot decide once and
+		// for all (for every row the mutation will process) which
+		// columns participate in the check: that depends on which of
+		// the referencing columns are NULL in each particular row,
+		// which isn't known until the row itself is being checked. So
+		// computeFkCheckColumnIDs only collects the full set of columns
+		// that *could* participate, same as SIMPLE; per-row callers use
+		// fkMatchPartialLookupPrefix (below) to decide, for a given row,
+		// whether to skip the check and how much of searchIdx's prefix
+		// to use as the KV scan prefix.
+		for i, writeColID := range mutatedIdx.ColumnIDs[:prefixLen] {
+			if found, ok := colMap[writeColID]; ok {
+				ids[searchIdx.ColumnIDs[i]] = found
+			} else {
+				return nil, errSkipUnusedFK
+			}
+		}
+		return ids, nil
 
 	default:
 		return nil, pgerror.AssertionFailedf("unknown composite key match type: %v", match)
 	}
 }
 
+// fkMatchPartialLookupPrefix implements the per-row decision required by
+// MATCH PARTIAL composite foreign keys (see
+// https://github.com/cockroachdb/cockroach/issues/20305 and
+// https://www.postgresql.org/docs/11/sql-createtable.html):
+//
+//   - if every value is NULL, the check is skipped entirely, exactly as
+//     with MATCH SIMPLE;
+//
+//   - otherwise the check must succeed iff there exists a row in the
+//     searched table whose non-NULL columns match the non-NULL values of
+//     this row. The leading run of non-NULL values (prefixLen) can be
+//     used directly as a KV scan prefix on searchIdx; the remaining
+//     positions become an open range for the scan, since a matching row
+//     is free to hold any value (including NULL) in those columns.
+//
+// values must be in the same column order as searchIdx, i.e. already
+// reordered via the ids map returned by computeFkCheckColumnIDs.
+//
+// If the non-NULL values don't form a contiguous prefix (e.g. (1, NULL,
+// 3)), prefixLen only covers the leading run (1, in that example), and
+// hasNonNullAfterPrefix reports that a caller building a scan from
+// prefixLen alone would still need to filter the fetched candidate rows
+// (via Fetcher) against the remaining non-NULL predicates, since they
+// cannot be expressed as a single contiguous KV key prefix.
+func fkMatchPartialLookupPrefix(
+	values tree.Datums,
+) (skip bool, prefixLen int, hasNonNullAfterPrefix bool) {
+	allNull := true
+	for _, v := range values {
+		if v != tree.DNull {
+			allNull = false
+			break
+		}
+	}
+	if allNull {
+		return true, 0, false
+	}
+
+	for prefixLen < len(values) && values[prefixLen] != tree.DNull {
+		prefixLen++
+	}
+	for i := prefixLen; i < len(values); i++ {
+		if values[i] != tree.DNull {
+			hasNonNullAfterPrefix = true
+			break
+		}
+	}
+	return false, prefixLen, hasNonNullAfterPrefix
+}
+
 var errSkipUnusedFK = errors.New("no columns involved in FK included in writer")
@@ -0,0 +1,170 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package row
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+func TestComputeFkCheckColumnIDsPartial(t *testing.T) {
+	mutatedIdx := &sqlbase.IndexDescriptor{
+		ColumnIDs:   []sqlbase.ColumnID{10, 11},
+		ColumnNames: []string{"a", "b"},
+	}
+	searchIdx := &sqlbase.IndexDescriptor{
+		ColumnIDs: []sqlbase.ColumnID{20, 21},
+	}
+
+	t.Run("all columns present", func(t *testing.T) {
+		colMap := map[sqlbase.ColumnID]int{10: 0, 11: 1}
+		ids, err := computeFkCheckColumnIDs(
+			sqlbase.ForeignKeyReference_PARTIAL, mutatedIdx, searchIdx, colMap, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[20] != 0 || ids[21] != 1 {
+			t.Fatalf("unexpected ids: %+v", ids)
+		}
+	})
+
+	t.Run("missing column yields errSkipUnusedFK", func(t *testing.T) {
+		colMap := map[sqlbase.ColumnID]int{10: 0}
+		_, err := computeFkCheckColumnIDs(
+			sqlbase.ForeignKeyReference_PARTIAL, mutatedIdx, searchIdx, colMap, 2)
+		if err != errSkipUnusedFK {
+			t.Fatalf("expected errSkipUnusedFK, got %v", err)
+		}
+	})
+}
+
+func TestCheckRowSkipsAllNullPartialMatch(t *testing.T) {
+	h := fkExistenceCheckBaseHelper{
+		ref: sqlbase.ForeignKeyReference{Match: sqlbase.ForeignKeyReference_PARTIAL},
+	}
+	values := tree.Datums{tree.DNull, tree.DNull}
+	// An all-NULL row under MATCH PARTIAL is skipped before checkRow ever
+	// needs searchPrefix, cache or txn, so this must not panic despite h
+	// otherwise being zero-valued.
+	if err := h.checkRow(context.Background(), values); err != nil {
+		t.Fatalf("expected an all-NULL MATCH PARTIAL row to be skipped, got %v", err)
+	}
+}
+
+func TestCheckRowRejectsNonContiguousNullPartialMatch(t *testing.T) {
+	h := fkExistenceCheckBaseHelper{
+		ref: sqlbase.ForeignKeyReference{Match: sqlbase.ForeignKeyReference_PARTIAL},
+	}
+	values := tree.Datums{tree.NewDInt(1), tree.DNull, tree.NewDInt(3)}
+	// checkRow must report an error (not silently check only the
+	// leading prefix) for a row whose non-NULL values aren't
+	// contiguous, same as TestCheckRowSkipsAllNullPartialMatch this must
+	// happen before h.searchPrefix, cache or txn are ever touched.
+	err := h.checkRow(context.Background(), values)
+	if err == nil {
+		t.Fatal("expected an error for a non-contiguous-NULL MATCH PARTIAL row, got nil")
+	}
+}
+
+func TestCheckRowsChecksMultipleRowsTogether(t *testing.T) {
+	h := fkExistenceCheckBaseHelper{
+		cache:        newFkExistenceCache(),
+		tableIndex:   fkExistenceCacheTableIndex{tableID: sqlbase.ID(1), indexID: sqlbase.IndexID(1)},
+		searchPrefix: []byte{0xff},
+		searchTable:  &sqlbase.ImmutableTableDescriptor{TableDescriptor: sqlbase.TableDescriptor{Name: "parent"}},
+		searchIdx:    &sqlbase.IndexDescriptor{Name: "primary"},
+	}
+
+	rows := []tree.Datums{
+		{tree.NewDInt(1)},
+		{tree.NewDInt(2)},
+		{tree.NewDInt(3)},
+	}
+	keys := make([][]byte, len(rows))
+	for i, row := range rows {
+		key, err := h.buildLookupKey(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	// Every row's existence is pre-cached, so checkRows' single call to
+	// existsBatch is satisfied entirely from the cache - this is what
+	// lets the test exercise checkRows with more than one key without a
+	// KV transaction to back it.
+	h.cache.update(h.tableIndex, keys[0], true)
+	h.cache.update(h.tableIndex, keys[1], true)
+	h.cache.update(h.tableIndex, keys[2], false)
+
+	if err := h.checkRows(context.Background(), rows[:2]); err != nil {
+		t.Fatalf("expected no error for two existing rows checked together, got %v", err)
+	}
+	if err := h.checkRows(context.Background(), rows); err == nil {
+		t.Fatal("expected a violation error when one of several rows checked together doesn't exist")
+	}
+}
+
+func TestFkMatchPartialLookupPrefix(t *testing.T) {
+	one := tree.NewDInt(1)
+	three := tree.NewDInt(3)
+
+	testCases := []struct {
+		name                  string
+		values                tree.Datums
+		skip                  bool
+		prefixLen             int
+		hasNonNullAfterPrefix bool
+	}{
+		{
+			name:   "all null",
+			values: tree.Datums{tree.DNull, tree.DNull, tree.DNull},
+			skip:   true,
+		},
+		{
+			name:      "all non-null",
+			values:    tree.Datums{one, three},
+			prefixLen: 2,
+		},
+		{
+			name:      "contiguous non-null prefix",
+			values:    tree.Datums{one, tree.DNull, tree.DNull},
+			prefixLen: 1,
+		},
+		{
+			name:                  "non-contiguous non-null values",
+			values:                tree.Datums{one, tree.DNull, three},
+			prefixLen:             1,
+			hasNonNullAfterPrefix: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			skip, prefixLen, hasNonNullAfterPrefix := fkMatchPartialLookupPrefix(tc.values)
+			if skip != tc.skip {
+				t.Errorf("skip: got %v, expected %v", skip, tc.skip)
+			}
+			if prefixLen != tc.prefixLen {
+				t.Errorf("prefixLen: got %d, expected %d", prefixLen, tc.prefixLen)
+			}
+			if hasNonNullAfterPrefix != tc.hasNonNullAfterPrefix {
+				t.Errorf("hasNonNullAfterPrefix: got %v, expected %v",
+					hasNonNullAfterPrefix, tc.hasNonNullAfterPrefix)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package row
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
+)
+
+// fkExistenceCacheSize bounds the number of entries retained by each
+// per-table-index cache maintained by fkExistenceCache. A value of 0
+// disables the cache entirely, which is useful for isolating the effect
+// of the cache when investigating a regression.
+var fkExistenceCacheSize = settings.RegisterIntSetting(
+	"sql.fk_existence_check_cache.size",
+	"the maximum number of entries retained by the per-transaction cache of "+
+		"foreign key existence check results, per referenced table/index "+
+		"(0 disables the cache)",
+	4096,
+)
+
+// fkExistenceCacheKey is the byte representation of the searched index's
+// KV key for one existence check, i.e. searchPrefix followed by the
+// encoded lookup values. It is declared as a distinct type, rather than
+// passed to the cache as a raw []byte, to make clear that the cache never
+// retains a reference to a caller-owned byte slice: the conversion to
+// string below always copies.
+type fkExistenceCacheKey string
+
+// fkExistenceCacheTableIndex identifies the table/index pair an existence
+// check was performed against. It is used both to select the right
+// sub-cache for a lookup, and as the granularity at which the cache is
+// invalidated when the transaction issues a DML statement.
+type fkExistenceCacheTableIndex struct {
+	tableID sqlbase.ID
+	indexID sqlbase.IndexID
+}
+
+// fkExistenceCacheStats tracks hit/miss counters for a fkExistenceCache, so
+// that EXPLAIN ANALYZE and crdb_internal introspection can report whether
+// the cache is actually helping on a given statement.
+type fkExistenceCacheStats struct {
+	hits   int64
+	misses int64
+}
+
+// Hits returns the number of cache hits recorded so far.
+func (s *fkExistenceCacheStats) Hits() int64 { return s.hits }
+
+// Misses returns the number of cache misses recorded so far.
+func (s *fkExistenceCacheStats) Misses() int64 { return s.misses }
+
+// fkExistenceCache memoizes the result of FK existence checks performed
+// by a fkExistenceCheckBaseHelper, keyed by the KV key bytes used to
+// perform the lookup (searchPrefix plus the encoded lookup values). This
+// avoids repeating a KV round-trip when a bulk INSERT/UPDATE mutates many
+// rows that reuse the same referenced value, e.g. loading a batch of
+// child rows that all point at the same parent.
+//
+// The cache is invalidated at the granularity of one table/index pair
+// whenever the same transaction issues a DML statement against it, rather
+// than tracking which individual keys were affected - this mirrors the
+// invalidation scheme Ur/Web's sqlcache uses for cached query results,
+// where any write to a table drops every cached result that depends on
+// it, rather than attempting to prove which specific cached rows survive.
+//
+// A fkExistenceCache is not safe for concurrent use; it is owned by the
+// fkExistenceCheckBaseHelper (or helpers, via UseSharedCache) processing
+// one mutation on one goroutine.
+type fkExistenceCache struct {
+	// sv, if set via SetClusterSettings, is consulted on every update and
+	// eviction check (not on lookup) so that changes to sql.fk_existence_check_cache.size
+	// take effect without requiring the transaction to restart. Until a
+	// caller has a *settings.Values to provide (e.g. from the session's
+	// exec config), the cache falls back to the setting's compiled-in
+	// default.
+	sv *settings.Values
+
+	// tables holds one LRU cache per table/index pair that has been
+	// looked up so far. Entries are created lazily, and dropped entirely
+	// (rather than scanned for matching keys) when invalidate is called,
+	// since that's cheaper and matches the coarse invalidation the
+	// cluster setting already accepts as a tradeoff.
+	tables map[fkExistenceCacheTableIndex]*cache.UnorderedCache
+
+	stats fkExistenceCacheStats
+}
+
+// newFkExistenceCache constructs an empty FK existence check cache, sized
+// from the compiled-in default for sql.fk_existence_check_cache.size
+// until SetClusterSettings is called.
+func newFkExistenceCache() *fkExistenceCache {
+	return &fkExistenceCache{
+		tables: make(map[fkExistenceCacheTableIndex]*cache.UnorderedCache),
+	}
+}
+
+// SetClusterSettings makes the cache track the live value of
+// sql.fk_existence_check_cache.size instead of its compiled-in default.
+func (c *fkExistenceCache) SetClusterSettings(sv *settings.Values) {
+	c.sv = sv
+}
+
+// maxSize returns the current cache size bound: the live cluster setting
+// value if SetClusterSettings has been called, otherwise its compiled-in
+// default.
+func (c *fkExistenceCache) maxSize() int64 {
+	if c.sv == nil {
+		return fkExistenceCacheSize.Default()
+	}
+	return fkExistenceCacheSize.Get(c.sv)
+}
+
+// lookup returns the memoized existence result for the given table/index
+// and KV lookup key, if a (non-invalidated) entry is cached.
+func (c *fkExistenceCache) lookup(ti fkExistenceCacheTableIndex, key []byte) (exists, ok bool) {
+	tc, found := c.tables[ti]
+	if !found {
+		c.stats.misses++
+		return false, false
+	}
+	v, found := tc.Get(fkExistenceCacheKey(key))
+	if !found {
+		c.stats.misses++
+		return false, false
+	}
+	c.stats.hits++
+	return v.(bool), true
+}
+
+// update memoizes the result of an existence check for later lookups
+// against the same table/index.
+func (c *fkExistenceCache) update(ti fkExistenceCacheTableIndex, key []byte, exists bool) {
+	if c.maxSize() <= 0 {
+		return
+	}
+	c.tableCache(ti).Add(fkExistenceCacheKey(key), exists)
+}
+
+// tableCache returns (creating it if necessary) the LRU cache for the
+// given table/index pair.
+func (c *fkExistenceCache) tableCache(ti fkExistenceCacheTableIndex) *cache.UnorderedCache {
+	tc, ok := c.tables[ti]
+	if !ok {
+		tc = cache.NewUnorderedCache(cache.Config{
+			Policy: cache.CacheLRU,
+			ShouldEvict: func(size int, _, _ interface{}) bool {
+				maxSize := c.maxSize()
+				return maxSize > 0 && int64(size) > maxSize
+			},
+		})
+		c.tables[ti] = tc
+	}
+	return tc
+}
+
+// invalidate drops every entry cached for the given table/index pair, so
+// that subsequent existence checks can no longer observe data that a DML
+// statement against that table may have changed. Its only caller is
+// fkExistenceCheckBaseHelper.invalidateCache; nothing in this package
+// calls that when a DML statement is issued.
+func (c *fkExistenceCache) invalidate(ti fkExistenceCacheTableIndex) {
+	delete(c.tables, ti)
+}
+
+// existsBatch checks, for each of the given searched-index lookup keys,
+// whether a matching row exists. Cached results are consulted first; any
+// remaining keys are coalesced into a single KV Batch (one Scan per key,
+// since the keys share the searchPrefix and can be issued in parallel as
+// part of the same round-trip) rather than issued as one separate lookup
+// per mutated row.
+func (h *fkExistenceCheckBaseHelper) existsBatch(
+	ctx context.Context, keys [][]byte,
+) (map[string]bool, error) {
+	result := make(map[string]bool, len(keys))
+	misses := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if exists, ok := h.cache.lookup(h.tableIndex, key); ok {
+			result[string(key)] = exists
+			continue
+		}
+		misses = append(misses, key)
+	}
+	if len(misses) == 0 {
+		return result, nil
+	}
+
+	b := &client.Batch{}
+	for _, key := range misses {
+		b.Scan(roachpb.Key(key), roachpb.Key(key).PrefixEnd())
+	}
+	if err := h.txn.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	for i, key := range misses {
+		exists := len(b.Results[i].Rows) > 0
+		result[string(key)] = exists
+		h.cache.update(h.tableIndex, key, exists)
+	}
+	return result, nil
+}
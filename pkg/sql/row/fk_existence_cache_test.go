@@ -0,0 +1,84 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package row
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+)
+
+func TestFkExistenceCache(t *testing.T) {
+	c := newFkExistenceCache()
+
+	ti1 := fkExistenceCacheTableIndex{tableID: sqlbase.ID(1), indexID: sqlbase.IndexID(1)}
+	ti2 := fkExistenceCacheTableIndex{tableID: sqlbase.ID(2), indexID: sqlbase.IndexID(1)}
+
+	if _, ok := c.lookup(ti1, []byte("a")); ok {
+		t.Fatal("expected miss on empty cache")
+	}
+
+	c.update(ti1, []byte("a"), true)
+	c.update(ti1, []byte("b"), false)
+	c.update(ti2, []byte("a"), true)
+
+	if exists, ok := c.lookup(ti1, []byte("a")); !ok || !exists {
+		t.Fatalf("expected cached hit (true), got ok=%v exists=%v", ok, exists)
+	}
+	if exists, ok := c.lookup(ti1, []byte("b")); !ok || exists {
+		t.Fatalf("expected cached hit (false), got ok=%v exists=%v", ok, exists)
+	}
+
+	// Invalidating ti1 must not affect ti2's entries.
+	c.invalidate(ti1)
+	if _, ok := c.lookup(ti1, []byte("a")); ok {
+		t.Fatal("expected miss after invalidation")
+	}
+	if exists, ok := c.lookup(ti2, []byte("a")); !ok || !exists {
+		t.Fatalf("expected ti2 entry to survive ti1 invalidation, got ok=%v exists=%v", ok, exists)
+	}
+
+	if h, m := c.stats.Hits(), c.stats.Misses(); h == 0 || m == 0 {
+		t.Fatalf("expected non-zero hits and misses, got hits=%d misses=%d", h, m)
+	}
+}
+
+func TestFkExistenceCacheSizeZeroDisables(t *testing.T) {
+	sv := &cluster.MakeTestingClusterSettings().SV
+	fkExistenceCacheSize.Override(sv, 0)
+	c := newFkExistenceCache()
+	c.SetClusterSettings(sv)
+
+	ti := fkExistenceCacheTableIndex{tableID: sqlbase.ID(1), indexID: sqlbase.IndexID(1)}
+	c.update(ti, []byte("a"), true)
+
+	if _, ok := c.lookup(ti, []byte("a")); ok {
+		t.Fatal("expected cache to stay empty when size setting is 0")
+	}
+}
+
+func TestFkExistenceCacheUseSharedCache(t *testing.T) {
+	shared := newFkExistenceCache()
+	ti := fkExistenceCacheTableIndex{tableID: sqlbase.ID(1), indexID: sqlbase.IndexID(1)}
+
+	h1 := fkExistenceCheckBaseHelper{cache: newFkExistenceCache(), tableIndex: ti}
+	h2 := fkExistenceCheckBaseHelper{cache: newFkExistenceCache(), tableIndex: ti}
+	h1.UseSharedCache(shared)
+	h2.UseSharedCache(shared)
+
+	h1.cache.update(h1.tableIndex, []byte("a"), true)
+	if exists, ok := h2.cache.lookup(h2.tableIndex, []byte("a")); !ok || !exists {
+		t.Fatalf("expected helper sharing the cache to observe the other's entry, got ok=%v exists=%v", ok, exists)
+	}
+}
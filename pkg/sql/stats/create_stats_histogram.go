@@ -0,0 +1,61 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package stats
+
+import "github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+
+// CreateStatsHistogramOptions captures the histogram-building knobs a
+// CREATE STATISTICS ... WITH OPTIONS statement can select. Algorithm
+// defaults to the zero value, EquiDepthAlgorithm, so a caller that never
+// parsed a WITH OPTIONS clause (every existing call site, today) gets the
+// pre-existing behavior unchanged.
+type CreateStatsHistogramOptions struct {
+	Algorithm HistogramAlgorithm
+}
+
+// CreateStatsHistogramResult pairs a built histogram with the algorithm
+// that produced it. HistogramData itself has no algorithm field - it is
+// shared with the read path that interprets already-stored statistics,
+// and isn't the place to thread a column unique to the moment of
+// construction - so BuildHistogramForCreateStats reports it alongside
+// the histogram instead.
+type CreateStatsHistogramResult struct {
+	Histogram HistogramData
+	Algorithm HistogramAlgorithm
+}
+
+// BuildHistogramForCreateStats builds the histogram for a column from a
+// sorted, NULL-free sample collected for CREATE STATISTICS: it resolves opts.Algorithm to a concrete HistogramBuilder and
+// runs it.
+//
+// TODO(knz): the CREATE STATISTICS job and its WITH OPTIONS parsing live
+// outside pkg/sql/stats and aren't part of this checkout, so this
+// function has no caller yet in this tree. Wiring it in means: (1)
+// teaching the parser to accept WITH OPTIONS ALGORITHM = 'max_diff' (or
+// similar) on CREATE STATISTICS, and (2) having the sampling job pass the
+// parsed CreateStatsHistogramOptions here instead of calling
+// EquiDepthHistogram directly. Until then this is reachable only from
+// tests in this package.
+func BuildHistogramForCreateStats(
+	evalCtx *tree.EvalContext,
+	samples tree.Datums,
+	numRows int64,
+	maxBuckets int,
+	opts CreateStatsHistogramOptions,
+) (CreateStatsHistogramResult, error) {
+	h, err := histogramBuilderForAlgorithm(opts.Algorithm).Build(evalCtx, samples, numRows, maxBuckets)
+	if err != nil {
+		return CreateStatsHistogramResult{}, err
+	}
+	return CreateStatsHistogramResult{Histogram: h, Algorithm: opts.Algorithm}, nil
+}
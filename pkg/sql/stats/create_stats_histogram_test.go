@@ -0,0 +1,49 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+func TestBuildHistogramForCreateStats(t *testing.T) {
+	evalCtx := tree.NewTestingEvalContext(cluster.MakeTestingClusterSettings())
+	samples := tree.Datums{tree.NewDInt(1), tree.NewDInt(2), tree.NewDInt(4), tree.NewDInt(5)}
+
+	testCases := []struct {
+		name string
+		opts CreateStatsHistogramOptions
+	}{
+		{name: "default is equi-depth", opts: CreateStatsHistogramOptions{}},
+		{name: "max-diff", opts: CreateStatsHistogramOptions{Algorithm: MaxDiffAlgorithm}},
+		{name: "compressed", opts: CreateStatsHistogramOptions{Algorithm: CompressedAlgorithm}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := BuildHistogramForCreateStats(evalCtx, samples, 4, 3, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Algorithm != tc.opts.Algorithm {
+				t.Fatalf("expected algorithm %v, got %v", tc.opts.Algorithm, res.Algorithm)
+			}
+			if len(res.Histogram.Buckets) == 0 {
+				t.Fatal("expected at least one bucket")
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2019 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL.txt and at www.mariadb.com/bsl11.
+//
+// Change Date: 2022-10-01
+//
+// On the date above, in accordance with the Business Source License, use
+// of this software will be governed by the Apache License, Version 2.0,
+// included in the file licenses/APL.txt and at
+// https://www.apache.org/licenses/LICENSE-2.0
+
+package stats
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+)
+
+// HistogramAlgorithm identifies which HistogramBuilder was used to
+// construct a particular histogram. It is not stored in HistogramData;
+// BuildHistogramForCreateStats returns it next to the histogram in a
+// CreateStatsHistogramResult.
+type HistogramAlgorithm int
+
+const (
+	// EquiDepthAlgorithm places bucket boundaries so that each bucket
+	// holds (approximately) the same number of rows. It has historically
+	// been CockroachDB's only histogram builder, and remains the
+	// default.
+	EquiDepthAlgorithm HistogramAlgorithm = iota
+	// MaxDiffAlgorithm approximates a V-Optimal histogram: it places
+	// boundaries at the largest gaps in cumulative frequency between
+	// adjacent distinct values, which keeps heavy hitters from being
+	// split across a bucket boundary the way equi-depth placement can.
+	MaxDiffAlgorithm
+	// CompressedAlgorithm stores the most frequent sample values
+	// verbatim as singleton buckets, then builds an equi-depth histogram
+	// over the remaining, less skewed residual.
+	CompressedAlgorithm
+)
+
+// HistogramBuilder constructs a HistogramData approximating the
+// distribution that a sorted, NULL-free sample of datums was drawn from.
+// equiDepthBuilder (wrapping the pre-existing EquiDepthHistogram) and the
+// other implementations in this file all satisfy this interface, so that
+// CREATE STATISTICS can select an estimator without the caller needing
+// to know which concrete algorithm produced the result.
+type HistogramBuilder interface {
+	// Build constructs a histogram. samples must be sorted in ascending
+	// order (per evalCtx) and must not contain NULL values. numRows is
+	// the total number of rows the sample was drawn from, not
+	// len(samples); maxBuckets bounds the number of buckets produced.
+	Build(
+		evalCtx *tree.EvalContext, samples tree.Datums, numRows int64, maxBuckets int,
+	) (HistogramData, error)
+}
+
+// histogramBuilderForAlgorithm returns the HistogramBuilder corresponding
+// to alg, for use by CREATE STATISTICS ... WITH OPTIONS.
+func histogramBuilderForAlgorithm(alg HistogramAlgorithm) HistogramBuilder {
+	switch alg {
+	case MaxDiffAlgorithm:
+		return maxDiffBuilder{}
+	case CompressedAlgorithm:
+		return compressedBuilder{topN: defaultCompressedTopN}
+	default:
+		return equiDepthBuilder{}
+	}
+}
+
+// defaultCompressedTopN is the number of most-frequent values that
+// compressedBuilder stores verbatim as singleton buckets before falling
+// back to an equi-depth histogram over the residual.
+const defaultCompressedTopN = 4
+
+// equiDepthBuilder adapts the pre-existing EquiDepthHistogram to the
+// HistogramBuilder interface.
+type equiDepthBuilder struct{}
+
+// Build is part of the HistogramBuilder interface.
+func (equiDepthBuilder) Build(
+	evalCtx *tree.EvalContext, samples tree.Datums, numRows int64, maxBuckets int,
+) (HistogramData, error) {
+	return EquiDepthHistogram(evalCtx, samples, numRows, maxBuckets)
+}
+
+// distinctValue is one distinct value from a sorted sample, along with
+// the number of times it occurred in the sample.
+type distinctValue struct {
+	value tree.Datum
+	count int64
+}
+
+// collectDistinctValues collapses a sorted sample into its distinct
+// values, each paired with its occurrence count in the sample.
+func collectDistinctValues(evalCtx *tree.EvalContext, samples tree.Datums) []distinctValue {
+	distincts := make([]distinctValue, 0, len(samples))
+	for _, s := range samples {
+		if n := len(distincts); n > 0 && distincts[n-1].value.Compare(evalCtx, s) == 0 {
+			distincts[n-1].count++
+			continue
+		}
+		distincts = append(distincts, distinctValue{value: s, count: 1})
+	}
+	return distincts
+}
+
+// maxDiffBuilder builds an approximation of a V-Optimal histogram: bucket
+// boundaries are placed at the largest gaps in cumulative frequency
+// between adjacent distinct sample values, rather than at fixed row-count
+// intervals as EquiDepthHistogram does. This tends to produce tighter
+// selectivity estimates for heavy hitters that would otherwise straddle
+// an equi-depth bucket boundary.
+type maxDiffBuilder struct{}
+
+// Build is part of the HistogramBuilder interface.
+func (maxDiffBuilder) Build(
+	evalCtx *tree.EvalContext, samples tree.Datums, numRows int64, maxBuckets int,
+) (HistogramData, error) {
+	if len(samples) == 0 || maxBuckets < 1 {
+		return HistogramData{}, nil
+	}
+
+	sorted := append(tree.Datums(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Compare(evalCtx, sorted[j]) < 0
+	})
+	distincts := collectDistinctValues(evalCtx, sorted)
+
+	numBuckets := maxBuckets
+	if numBuckets > len(distincts) {
+		numBuckets = len(distincts)
+	}
+
+	// rowsPerSample scales sample frequencies up to the full row count,
+	// the same way EquiDepthHistogram does.
+	rowsPerSample := float64(numRows) / float64(len(sorted))
+
+	// c[i] is the cumulative sample count through distinct value i.
+	c := make([]int64, len(distincts))
+	var running int64
+	for i, d := range distincts {
+		running += d.count
+		c[i] = running
+	}
+
+	// Find the numBuckets-1 largest gaps in cumulative frequency between
+	// adjacent distinct values; these become the internal bucket
+	// boundaries. The last distinct value is always a boundary, since it
+	// must be the upper bound of the final bucket.
+	type gap struct {
+		idx  int
+		size int64
+	}
+	gaps := make([]gap, 0, len(distincts)-1)
+	for i := 0; i < len(distincts)-1; i++ {
+		gaps = append(gaps, gap{idx: i, size: c[i+1] - c[i]})
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i].size > gaps[j].size })
+	if len(gaps) > numBuckets-1 {
+		gaps = gaps[:numBuckets-1]
+	}
+	boundaries := make([]int, 0, len(gaps)+1)
+	for _, g := range gaps {
+		boundaries = append(boundaries, g.idx)
+	}
+	boundaries = append(boundaries, len(distincts)-1)
+	sort.Ints(boundaries)
+
+	h := HistogramData{}
+	lower := 0
+	for _, upper := range boundaries {
+		encoded, err := sqlbase.EncodeTableKey(nil, distincts[upper].value, encoding.Ascending)
+		if err != nil {
+			return HistogramData{}, err
+		}
+		var numRange int64
+		for i := lower; i < upper; i++ {
+			numRange += distincts[i].count
+		}
+		h.Buckets = append(h.Buckets, HistogramData_Bucket{
+			NumEq:      int64(float64(distincts[upper].count) * rowsPerSample),
+			NumRange:   int64(float64(numRange) * rowsPerSample),
+			UpperBound: encoded,
+		})
+		lower = upper + 1
+	}
+	return h, nil
+}
+
+// compressedBuilder stores the topN most frequent sample values verbatim
+// as singleton buckets, then builds an equi-depth histogram over the
+// residual samples (those not among the topN). This keeps a small number
+// of heavy hitters exact while still bounding the total bucket count.
+type compressedBuilder struct {
+	topN int
+}
+
+// Build is part of the HistogramBuilder interface.
+func (b compressedBuilder) Build(
+	evalCtx *tree.EvalContext, samples tree.Datums, numRows int64, maxBuckets int,
+) (HistogramData, error) {
+	if len(samples) == 0 || maxBuckets < 1 {
+		return HistogramData{}, nil
+	}
+
+	topN := b.topN
+	if topN > maxBuckets-1 {
+		topN = maxBuckets - 1
+	}
+	if topN < 0 {
+		topN = 0
+	}
+
+	sorted := append(tree.Datums(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Compare(evalCtx, sorted[j]) < 0
+	})
+	distincts := collectDistinctValues(evalCtx, sorted)
+
+	if topN > len(distincts) {
+		topN = len(distincts)
+	}
+	byFrequency := append([]distinctValue(nil), distincts...)
+	sort.SliceStable(byFrequency, func(i, j int) bool {
+		return byFrequency[i].count > byFrequency[j].count
+	})
+	top := byFrequency[:topN]
+
+	topSet := make(map[int]bool, topN)
+	for _, t := range top {
+		for i, d := range distincts {
+			if d.value.Compare(evalCtx, t.value) == 0 {
+				topSet[i] = true
+				break
+			}
+		}
+	}
+
+	encoded := make([][]byte, len(distincts))
+	for i, d := range distincts {
+		enc, err := sqlbase.EncodeTableKey(nil, d.value, encoding.Ascending)
+		if err != nil {
+			return HistogramData{}, err
+		}
+		encoded[i] = enc
+	}
+
+	rowsPerSample := float64(numRows) / float64(len(sorted))
+
+	var residual tree.Datums
+	var topNumEq int64
+	for i, d := range distincts {
+		if topSet[i] {
+			topNumEq += int64(float64(d.count) * rowsPerSample)
+			continue
+		}
+		for k := int64(0); k < d.count; k++ {
+			residual = append(residual, d.value)
+		}
+	}
+
+	// boundary[i] marks that distincts[i] is the upper bound of some
+	// bucket in the final histogram: every top value is always a
+	// boundary (it gets its own singleton bucket); the residual values
+	// EquiDepthHistogram groups into equi-depth buckets contribute their
+	// bucket upper bounds as boundaries too. Used on its own, this only
+	// tells us *where* the final buckets fall - NumRange for each is
+	// computed below from the merged order, not from EquiDepthHistogram's
+	// residual-only neighbors, since a top bucket can end up spliced
+	// between two residual boundaries that were adjacent in the
+	// residual-only computation but aren't anymore.
+	boundary := make([]bool, len(distincts))
+	for i := range distincts {
+		if topSet[i] {
+			boundary[i] = true
+		}
+	}
+
+	if len(residual) > 0 {
+		residualBuckets := maxBuckets - topN
+		if residualBuckets < 1 {
+			residualBuckets = 1
+		}
+		residualRows := numRows - topNumEq
+		residualHist, err := EquiDepthHistogram(evalCtx, residual, residualRows, residualBuckets)
+		if err != nil {
+			return HistogramData{}, err
+		}
+		for _, rb := range residualHist.Buckets {
+			for i, enc := range encoded {
+				if !topSet[i] && bytes.Equal(enc, rb.UpperBound) {
+					boundary[i] = true
+					break
+				}
+			}
+		}
+	}
+
+	// Emit one bucket per boundary, in ascending distinct-value order.
+	// NumRange is the number of sample rows (scaled to numRows) since the
+	// previous boundary (top or residual, whichever actually precedes this one
+	// once the two are interleaved) up to but excluding this boundary -
+	// this is what makes range estimates correct for predicates that
+	// fall between a top singleton and its neighboring residual bucket.
+	h := HistogramData{}
+	var pending int64
+	for i, d := range distincts {
+		if !boundary[i] {
+			pending += d.count
+			continue
+		}
+		h.Buckets = append(h.Buckets, HistogramData_Bucket{
+			NumEq:      int64(float64(d.count) * rowsPerSample),
+			NumRange:   int64(float64(pending) * rowsPerSample),
+			UpperBound: encoded[i],
+		})
+		pending = 0
+	}
+
+	return h, nil
+}